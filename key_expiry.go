@@ -0,0 +1,136 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+// ErrDataKeyInUse is returned by RevokeKey when the requested key is still
+// referenced by a live SSTable or value log file. Run RewriteEncryptedFiles
+// to migrate that data off the key before revoking it.
+var ErrDataKeyInUse = errors.New("badger: data key is still in use")
+
+// expiryCheckInterval is how often the background goroutine started by
+// Open checks for expired data keys when Options.DataKeyTTL is set.
+const expiryCheckInterval = 1 * time.Hour
+
+// PurgeExpiredKeys drops every data key that has both expired (per
+// Options.DataKeyTTL) and is no longer referenced by any live SSTable or
+// value log file. Keys still referenced by a live file are kept even past
+// expiry, since dropping them would make that file undecryptable; run
+// RewriteEncryptedFiles first to migrate data off an expired key before
+// purging it.
+//
+// Each purge only appends a recordExpireKey per dropped key rather than
+// rewriting the whole registry, so it stays cheap no matter how large the
+// registry has grown; call (*KeyRegistry).Compact periodically to reclaim
+// the space those appended records use.
+func (db *DB) PurgeExpiredKeys() error {
+	live := db.liveDataKeyIDs()
+	kr := db.registry
+
+	now := time.Now().Unix()
+	var purged []uint64
+	buf := &bytes.Buffer{}
+	var err error
+
+	kr.RLock()
+	for id, dk := range kr.dataKeys {
+		if dk.ExpiresAt == 0 || now <= dk.ExpiresAt || live[id] {
+			continue
+		}
+		purged = append(purged, id)
+	}
+	kr.RUnlock()
+
+	if len(purged) > 0 {
+		// kr.appendMu has to span the nextSeq bump as well as the write; see
+		// the comment on the equivalent section of generateDataKey.
+		kr.appendMu.Lock()
+		for _, id := range purged {
+			kr.nextSeq++
+			if err = storeKeyIDRecord(buf, kr.nextSeq, recordExpireKey, id); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			_, err = kr.fp.Write(buf.Bytes())
+			if err == nil {
+				err = y.FileSync(kr.fp)
+			}
+		}
+		kr.appendMu.Unlock()
+	}
+	if err == nil {
+		kr.Lock()
+		for _, id := range purged {
+			delete(kr.dataKeys, id)
+		}
+		kr.Unlock()
+	}
+
+	if err != nil {
+		return err
+	}
+	for _, id := range purged {
+		kr.publish(KeyEvent{Type: KeyEventExpired, KeyID: id})
+	}
+	return nil
+}
+
+// liveDataKeyIDs returns the set of data key IDs still referenced by a live
+// SSTable or value log file, so PurgeExpiredKeys never drops a key a file
+// on disk still depends on.
+func (db *DB) liveDataKeyIDs() map[uint64]bool {
+	live := make(map[uint64]bool)
+	for _, t := range db.lc.allTables() {
+		live[t.KeyID()] = true
+	}
+	for _, id := range db.vlog.liveKeyIDs() {
+		live[id] = true
+	}
+	return live
+}
+
+// runDataKeyExpiryLoop periodically calls PurgeExpiredKeys while
+// Options.DataKeyTTL is configured. Open starts this in its own goroutine,
+// guarded by lc, the same y.Closer-based shutdown mechanism used by
+// Badger's other background jobs.
+func (db *DB) runDataKeyExpiryLoop(lc *y.Closer) {
+	defer lc.Done()
+	if db.opt.DataKeyTTL <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lc.HasBeenClosed():
+			return
+		case <-ticker.C:
+			if err := db.PurgeExpiredKeys(); err != nil {
+				db.opt.Errorf("failed to purge expired data keys: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestDataKeyTTLExpiry checks that once Options.DataKeyTTL has elapsed on
+// the current data key, latestDataKey stops handing it out for new writes
+// and mints a fresh one instead, while dataKey can still resolve the
+// expired key by id so content already sealed under it stays decryptable
+// (without needing a full DB -- liveDataKeyIDs and PurgeExpiredKeys
+// additionally require a live LSM tree and value log, which this
+// package-local test doesn't set up).
+func TestDataKeyTTLExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-keyexpiry-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opt := Options{
+		Dir:           dir,
+		EncryptionKey: []byte("0123456789abcdef0123456789abcdef"),
+		DataKeyTTL:    time.Hour,
+	}
+	kr, err := OpenKeyRegistry(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kr.Close()
+
+	dk, err := kr.generateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dk.ExpiresAt == 0 {
+		t.Fatal("expected DataKeyTTL to set ExpiresAt")
+	}
+
+	// Simulate the TTL having already elapsed instead of sleeping an hour.
+	dk.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+
+	got, err := kr.dataKey(dk.KeyId)
+	if err != nil {
+		t.Fatalf("dataKey on an expired key should still resolve it: %v", err)
+	}
+	if got.KeyId != dk.KeyId {
+		t.Fatalf("got key %d, want the expired key %d", got.KeyId, dk.KeyId)
+	}
+
+	fresh, err := kr.latestDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh.KeyId == dk.KeyId {
+		t.Fatal("latestDataKey handed out an expired key for a new write")
+	}
+}
@@ -0,0 +1,289 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+// KDFAlgorithm selects the key-derivation function used to turn a
+// passphrase into an AES master key.
+type KDFAlgorithm string
+
+const (
+	// KDFScrypt derives the key with scrypt.
+	KDFScrypt KDFAlgorithm = "scrypt"
+	// KDFArgon2id derives the key with argon2id.
+	KDFArgon2id KDFAlgorithm = "argon2id"
+)
+
+const defaultKDFSaltLen = 16
+
+// defaultKeyLen is the length, in bytes, of the AES-256 master key derived
+// from a passphrase.
+const defaultKeyLen = 32
+
+var (
+	// ErrUnknownKDFAlgorithm is returned when a registry or key file names a
+	// KDF algorithm this version of Badger doesn't implement.
+	ErrUnknownKDFAlgorithm = errors.New("badger: unknown KDF algorithm")
+	// errPassphraseRequired is returned when a kdfParams block is present
+	// but the caller didn't supply a passphrase to derive the key with.
+	errPassphraseRequired = errors.New("badger: encryption passphrase required")
+)
+
+// kdfParams holds everything needed to re-derive the same master key from
+// the same passphrase: which KDF to use, its cost parameters, and the
+// random salt. It's persisted in the KEYREGISTRY header (for
+// Options.EncryptionPassphrase) and in JSON key files (for SaveKeyFile),
+// mirroring the encrypted keystore file design used by other passphrase-
+// protected key stores.
+type kdfParams struct {
+	Algorithm KDFAlgorithm `json:"algorithm"`
+	Salt      []byte       `json:"salt"`
+	KeyLen    int          `json:"key_len"`
+
+	// scrypt parameters.
+	ScryptN int `json:"scrypt_n,omitempty"`
+	ScryptR int `json:"scrypt_r,omitempty"`
+	ScryptP int `json:"scrypt_p,omitempty"`
+
+	// argon2id parameters.
+	Argon2Time    uint32 `json:"argon2_time,omitempty"`
+	Argon2Memory  uint32 `json:"argon2_memory,omitempty"`
+	Argon2Threads uint8  `json:"argon2_threads,omitempty"`
+}
+
+// newKDFParams builds a fresh kdfParams with a random salt, taking cost
+// parameters from opt when set and falling back to conservative defaults
+// otherwise.
+func newKDFParams(opt Options) (*kdfParams, error) {
+	saltLen := opt.KDFSaltLen
+	if saltLen <= 0 {
+		saltLen = defaultKDFSaltLen
+	}
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	algo := opt.KDFAlgorithm
+	if algo == "" {
+		algo = KDFArgon2id
+	}
+	p := &kdfParams{
+		Algorithm: algo,
+		Salt:      salt,
+		KeyLen:    defaultKeyLen,
+	}
+	switch algo {
+	case KDFScrypt:
+		p.ScryptN, p.ScryptR, p.ScryptP = opt.ScryptN, opt.ScryptR, opt.ScryptP
+		if p.ScryptN == 0 {
+			p.ScryptN = 1 << 15
+		}
+		if p.ScryptR == 0 {
+			p.ScryptR = 8
+		}
+		if p.ScryptP == 0 {
+			p.ScryptP = 1
+		}
+	case KDFArgon2id:
+		p.Argon2Time, p.Argon2Memory, p.Argon2Threads =
+			opt.Argon2Time, opt.Argon2Memory, opt.Argon2Threads
+		if p.Argon2Time == 0 {
+			p.Argon2Time = 1
+		}
+		if p.Argon2Memory == 0 {
+			p.Argon2Memory = 64 * 1024
+		}
+		if p.Argon2Threads == 0 {
+			p.Argon2Threads = 4
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKDFAlgorithm, algo)
+	}
+	return p, nil
+}
+
+// derive runs the configured KDF over passphrase and returns the resulting
+// master key.
+func (p *kdfParams) derive(passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errPassphraseRequired
+	}
+	switch p.Algorithm {
+	case KDFScrypt:
+		return scrypt.Key([]byte(passphrase), p.Salt, p.ScryptN, p.ScryptR, p.ScryptP, p.KeyLen)
+	case KDFArgon2id:
+		return argon2.IDKey([]byte(passphrase), p.Salt, p.Argon2Time, p.Argon2Memory,
+			p.Argon2Threads, uint32(p.KeyLen)), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKDFAlgorithm, p.Algorithm)
+	}
+}
+
+// marshalKDFParams serializes p for the KEYREGISTRY header. A nil p (no
+// passphrase mode configured) serializes to an empty slice.
+func marshalKDFParams(p *kdfParams) ([]byte, error) {
+	if p == nil {
+		return nil, nil
+	}
+	return json.Marshal(p)
+}
+
+// unmarshalKDFParams is the inverse of marshalKDFParams; an empty slice
+// yields a nil *kdfParams.
+func unmarshalKDFParams(data []byte) (*kdfParams, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	p := &kdfParams{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// providerForExistingRegistry peeks at the KDF header of an already-open
+// registry file to decide how to build its KeyProvider: if the file was
+// sealed in passphrase mode, the salt and cost parameters it was sealed
+// with are used to re-derive the master key from opt.EncryptionPassphrase,
+// regardless of what opt otherwise requests for a brand-new registry.
+func providerForExistingRegistry(fp *os.File, opt Options) (KeyProvider, error) {
+	if opt.KeyProvider != nil {
+		return opt.KeyProvider, nil
+	}
+	// Skip keyRegistryMagic, which always precedes the KDF params in the
+	// current format; callers only reach here once isLegacyKeyRegistry has
+	// already ruled out the pre-KeyProvider layout.
+	kdfBytes, _, err := readSlice(fp, int64(len(keyRegistryMagic)))
+	if err != nil {
+		return nil, err
+	}
+	kdf, err := unmarshalKDFParams(kdfBytes)
+	if err != nil {
+		return nil, err
+	}
+	return resolveKeyProvider(opt, kdf)
+}
+
+// keyFileVersion is the version field of the JSON key file format produced
+// by SaveKeyFile.
+const keyFileVersion = 1
+
+// keyFileJSON is the on-disk JSON key file format, with the fields version,
+// kdf (which carries the salt and KDF cost parameters), iv, ciphertext and
+// mac, modelled on go-ethereum's encrypted keystore files. It lets a master key be shipped on disk
+// without embedding it in a config file or process environment.
+type keyFileJSON struct {
+	Version    int       `json:"version"`
+	KDF        kdfParams `json:"kdf"`
+	IV         string    `json:"iv"`
+	Ciphertext string    `json:"ciphertext"`
+	MAC        string    `json:"mac"`
+}
+
+// SaveKeyFile derives a key-encryption key from passphrase, uses it to
+// encrypt key, and writes the result to path in the JSON key file format.
+// The salt and KDF cost parameters are stored alongside the ciphertext so
+// LoadKeyFile only needs the passphrase to recover key.
+func SaveKeyFile(path string, passphrase string, key []byte) error {
+	kdf, err := newKDFParams(Options{EncryptionPassphrase: passphrase})
+	if err != nil {
+		return err
+	}
+	kek, err := kdf.derive(passphrase)
+	if err != nil {
+		return err
+	}
+	iv, err := y.GenereateIV()
+	if err != nil {
+		return err
+	}
+	ciphertext, err := y.XORBlock(key, kek, iv)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, kek)
+	mac.Write(ciphertext)
+
+	out := keyFileJSON{
+		Version:    keyFileVersion,
+		KDF:        *kdf,
+		IV:         hex.EncodeToString(iv),
+		Ciphertext: hex.EncodeToString(ciphertext),
+		MAC:        hex.EncodeToString(mac.Sum(nil)),
+	}
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// LoadKeyFile reads a key file written by SaveKeyFile, re-derives the
+// key-encryption key from passphrase and the stored KDF parameters, checks
+// its integrity against the stored MAC, and returns the decrypted key.
+func LoadKeyFile(path string, passphrase string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var kf keyFileJSON
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return nil, err
+	}
+	if kf.Version != keyFileVersion {
+		return nil, fmt.Errorf("badger: unsupported key file version %d", kf.Version)
+	}
+	iv, err := hex.DecodeString(kf.IV)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := hex.DecodeString(kf.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	wantMAC, err := hex.DecodeString(kf.MAC)
+	if err != nil {
+		return nil, err
+	}
+
+	kek, err := kf.KDF.derive(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, kek)
+	mac.Write(ciphertext)
+	if !hmac.Equal(mac.Sum(nil), wantMAC) {
+		return nil, ErrEncryptionKeyMismatch
+	}
+	return y.XORBlock(ciphertext, kek, iv)
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// TestPassphraseKeyRegistryRoundTrip checks that a passphrase-sealed
+// registry can be reopened with the same passphrase, and rejects a wrong
+// one.
+func TestPassphraseKeyRegistryRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-keyregistry-passphrase-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opt := Options{Dir: dir, EncryptionPassphrase: "correct horse battery staple"}
+	kr, err := OpenKeyRegistry(opt)
+	if err != nil {
+		t.Fatalf("creating registry: %v", err)
+	}
+	dk, err := kr.latestDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenKeyRegistry(opt)
+	if err != nil {
+		t.Fatalf("reopening with the same passphrase: %v", err)
+	}
+	defer reopened.Close()
+	got, err := reopened.dataKey(dk.KeyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Data) != string(dk.Data) {
+		t.Fatalf("recovered data key differs from the original")
+	}
+
+	wrongOpt := Options{Dir: dir, EncryptionPassphrase: "wrong passphrase"}
+	if _, err := OpenKeyRegistry(wrongOpt); err == nil {
+		t.Fatal("expected an error opening the registry with the wrong passphrase")
+	}
+}
+
+// TestOpenKeyRegistry_KeyProviderMismatch checks that reopening a registry
+// wrapped by one KeyProvider with a different KeyProvider ID is rejected
+// instead of silently misinterpreting the ciphertext.
+func TestOpenKeyRegistry_KeyProviderMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-keyregistry-provider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	opt := Options{Dir: dir, KeyProvider: NewStaticKeyProvider(key)}
+	kr, err := OpenKeyRegistry(opt)
+	if err != nil {
+		t.Fatalf("creating registry: %v", err)
+	}
+	if _, err := kr.latestDataKey(); err != nil {
+		t.Fatal(err)
+	}
+	if err := kr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	otherOpt := Options{Dir: dir, KeyProvider: &renamedKeyProvider{inner: NewStaticKeyProvider(key)}}
+	if _, err := OpenKeyRegistry(otherOpt); err == nil {
+		t.Fatal("expected an error opening the registry with a differently-identified KeyProvider")
+	}
+}
+
+// renamedKeyProvider wraps a KeyProvider and reports a different ID, so
+// tests can simulate reopening a registry under the "wrong" provider
+// without needing two real, distinct wrapping implementations.
+type renamedKeyProvider struct {
+	inner KeyProvider
+}
+
+func (r *renamedKeyProvider) ID() string { return "renamed" }
+func (r *renamedKeyProvider) WrapKey(dataKey []byte) ([]byte, error) {
+	return r.inner.WrapKey(dataKey)
+}
+func (r *renamedKeyProvider) UnwrapKey(wrapped []byte) ([]byte, error) {
+	return r.inner.UnwrapKey(wrapped)
+}
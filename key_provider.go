@@ -0,0 +1,128 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"crypto/aes"
+	"errors"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+// plainKeyProviderID is the provider ID persisted when no master key or
+// custom KeyProvider is configured. Data keys stamped with it are stored
+// and returned unmodified.
+const plainKeyProviderID = "plain"
+
+// errTruncatedWrappedKey is returned when a wrapped data key read back from
+// the registry is too short to have been produced by WrapKey.
+var errTruncatedWrappedKey = errors.New("badger: truncated wrapped key")
+
+// ErrKeyProviderMismatch is returned when the registry (or one of its data
+// keys) was wrapped by a KeyProvider other than the one configured on
+// Options, so Badger refuses to unwrap it rather than risk misinterpreting
+// unrelated ciphertext.
+var ErrKeyProviderMismatch = errors.New("badger: registry was sealed with a different KeyProvider")
+
+// KeyProvider wraps and unwraps Badger's data keys with an externally held
+// master key, also called a Key Encryption Key (KEK). Implementations
+// typically delegate to a key-management service so the KEK itself never
+// has to live in a Badger config file or process memory, following the
+// envelope-encryption pattern used by key-management integrations in other
+// storage systems.
+//
+// ID must return a short, stable string identifying the provider and, where
+// relevant, which master key it holds (for example a Vault transit key name
+// or a KMS key ARN). KeyRegistry persists this ID alongside every wrapped
+// data key so that opening the registry with a different KeyProvider fails
+// with ErrKeyProviderMismatch instead of silently misinterpreting the
+// ciphertext.
+type KeyProvider interface {
+	// ID returns the stable identifier for this provider.
+	ID() string
+	// WrapKey encrypts dataKey under the provider's master key and returns
+	// the ciphertext to persist in the registry.
+	WrapKey(dataKey []byte) ([]byte, error)
+	// UnwrapKey decrypts a ciphertext previously returned by WrapKey.
+	UnwrapKey(wrapped []byte) ([]byte, error)
+}
+
+// staticKeyProvider is the default KeyProvider. It reproduces Badger's
+// original behaviour of encrypting data keys with a single, statically
+// configured master key held in memory.
+type staticKeyProvider struct {
+	key []byte
+}
+
+// NewStaticKeyProvider returns a KeyProvider backed by a raw, in-memory
+// master key, the same key previously passed as Options.EncryptionKey.
+// Passing an empty key yields a no-op provider that stores data keys
+// unencrypted.
+func NewStaticKeyProvider(key []byte) KeyProvider {
+	return &staticKeyProvider{key: key}
+}
+
+func (s *staticKeyProvider) ID() string {
+	if len(s.key) == 0 {
+		return plainKeyProviderID
+	}
+	return "static"
+}
+
+func (s *staticKeyProvider) WrapKey(dataKey []byte) ([]byte, error) {
+	if len(s.key) == 0 {
+		return dataKey, nil
+	}
+	iv, err := y.GenereateIV()
+	if err != nil {
+		return nil, err
+	}
+	ct, err := y.XORBlock(dataKey, s.key, iv)
+	if err != nil {
+		return nil, err
+	}
+	return append(iv, ct...), nil
+}
+
+func (s *staticKeyProvider) UnwrapKey(wrapped []byte) ([]byte, error) {
+	if len(s.key) == 0 {
+		return wrapped, nil
+	}
+	if len(wrapped) < aes.BlockSize {
+		return nil, errTruncatedWrappedKey
+	}
+	iv, ct := wrapped[:aes.BlockSize], wrapped[aes.BlockSize:]
+	return y.XORBlock(ct, s.key, iv)
+}
+
+// resolveKeyProvider picks the KeyProvider a KeyRegistry should use: the
+// caller supplied one if set; otherwise a passphrase-derived master key if
+// kdf is non-nil; otherwise a staticKeyProvider wrapping opt.EncryptionKey,
+// to preserve pre-KeyProvider behaviour.
+func resolveKeyProvider(opt Options, kdf *kdfParams) (KeyProvider, error) {
+	if opt.KeyProvider != nil {
+		return opt.KeyProvider, nil
+	}
+	if kdf != nil {
+		key, err := kdf.derive(opt.EncryptionPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		return NewStaticKeyProvider(key), nil
+	}
+	return NewStaticKeyProvider(opt.EncryptionKey), nil
+}
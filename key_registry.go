@@ -21,6 +21,7 @@ import (
 	"crypto/aes"
 	"crypto/rand"
 	"encoding/binary"
+	"fmt"
 	"hash/crc32"
 	"io"
 	"os"
@@ -39,6 +40,48 @@ const (
 	KeyRegistryRewriteFileName = "REWRITE-KEYREGISTRY"
 	// RotationPeriod is the key rotation period for datakey.
 	RotationPeriod = 10 * 24 * time.Hour
+	// dataKeySize is the size, in bytes, of a generated AES-256 data key.
+	// Unlike the master key, which may live behind a KeyProvider with no
+	// well-defined length (e.g. a KMS key ID), the data key is always
+	// generated by Badger itself, so its size is fixed.
+	dataKeySize = 32
+	// recordHeaderLen is the size, in bytes, of the sequence number and
+	// record type prefix written before every record in the append-only
+	// log: 8 bytes for the sequence number, 1 byte for the record type.
+	recordHeaderLen = 9
+)
+
+// keyRegistryMagic tags the start of every KEYREGISTRY file written by this
+// version of Badger onward. It lets readKeyRegistry tell the current
+// [kdf][providerID][wrapped sanity][records] layout apart from the
+// pre-KeyProvider format, a bare [16-byte IV][12-byte sanity][records]
+// header with no tag of its own, instead of misreading the old IV as a
+// bogus length prefix and failing to open.
+var keyRegistryMagic = []byte("BdgrKRv2")
+
+// legacyLenCrcLen is the record framing of the pre-KeyProvider KEYREGISTRY
+// layout: an AES IV, the (optionally encrypted) sanity text, and then
+// records framed as [4-byte length][4-byte crc][payload], with no KDF,
+// provider ID, sequence number, or record type recorded anywhere. Only a
+// statically configured EncryptionKey (no KeyProvider, no passphrase) can
+// have produced a file in this format.
+const legacyLenCrcLen = 8
+
+// recordType tags each record appended to the KEYREGISTRY log so that
+// readKeyRegistry knows how to interpret its payload and, on replay, what
+// effect it has on the in-memory dataKeys map.
+type recordType uint8
+
+const (
+	// recordAddKey introduces a new, live pb.DataKey.
+	recordAddKey recordType = iota + 1
+	// recordExpireKey marks a previously added data key as expired. Its
+	// payload is just the 8-byte big-endian key ID.
+	recordExpireKey
+	// recordRevokeKey marks a previously added data key as revoked ahead
+	// of its normal expiration, e.g. after a suspected compromise. Its
+	// payload is the 8-byte big-endian key ID.
+	recordRevokeKey
 )
 
 // SanityText is used to check whether the given user provided storage key is valid or not
@@ -47,18 +90,32 @@ var sanityText = []byte("Hello Badger")
 // KeyRegistry used to maintain all the data keys.
 type KeyRegistry struct {
 	sync.RWMutex
-	dataKeys      map[uint64]*pb.DataKey
-	lastCreated   int64 //lastCreated is the timestamp of the last data key generated.
-	nextKeyID     uint64
-	encryptionKey []byte
-	fp            *os.File
+	dataKeys    map[uint64]*pb.DataKey
+	lastCreated int64 //lastCreated is the timestamp of the last data key generated.
+	nextKeyID   uint64
+	provider    KeyProvider
+	dataKeyTTL  time.Duration
+	kdfParams   *kdfParams
+	nextSeq     uint64
+	subscribers map[uint64]chan KeyEvent
+	nextSubID   uint64
+	fp          *os.File
+	// appendMu serializes physical writes to fp across generateDataKey,
+	// RevokeKey, and PurgeExpiredKeys, which only need to append a record
+	// and so otherwise don't take the full write lock that guards
+	// dataKeys. Without it, two concurrent appends could interleave their
+	// writes, since a single os.File's current offset isn't itself a
+	// synchronization point.
+	appendMu sync.Mutex
 }
 
-func newKeyRegistry(storageKey []byte) *KeyRegistry {
+func newKeyRegistry(provider KeyProvider, dataKeyTTL time.Duration) *KeyRegistry {
 	return &KeyRegistry{
-		dataKeys:      make(map[uint64]*pb.DataKey),
-		nextKeyID:     0,
-		encryptionKey: storageKey,
+		dataKeys:    make(map[uint64]*pb.DataKey),
+		nextKeyID:   0,
+		provider:    provider,
+		dataKeyTTL:  dataKeyTTL,
+		subscribers: make(map[uint64]chan KeyEvent),
 	}
 }
 
@@ -75,8 +132,19 @@ func OpenKeyRegistry(opt Options) (*KeyRegistry, error) {
 		if !os.IsNotExist(err) {
 			return nil, err
 		}
+		var kdf *kdfParams
+		if opt.EncryptionPassphrase != "" {
+			if kdf, err = newKDFParams(opt); err != nil {
+				return nil, err
+			}
+		}
+		provider, err := resolveKeyProvider(opt, kdf)
+		if err != nil {
+			return nil, err
+		}
 		// Creating new registry file if not exist.
-		kr := newKeyRegistry(opt.EncryptionKey)
+		kr := newKeyRegistry(provider, opt.DataKeyTTL)
+		kr.kdfParams = kdf
 		if opt.ReadOnly {
 			return kr, nil
 		}
@@ -89,13 +157,68 @@ func OpenKeyRegistry(opt Options) (*KeyRegistry, error) {
 			return nil, err
 		}
 	}
-	kr, err := readKeyRegistry(fp, opt.EncryptionKey)
+	// Guard the registry file with an advisory lock so a second process
+	// can't open and mutate it concurrently and corrupt the log.
+	if !opt.ReadOnly {
+		if err := flockRegistry(fp); err != nil {
+			fp.Close()
+			return nil, fmt.Errorf("badger: cannot lock %s, is another process using this Badger instance? %w",
+				path, err)
+		}
+	}
+	legacy, err := isLegacyKeyRegistry(fp)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	var kr *KeyRegistry
+	if legacy {
+		// The pre-KeyProvider format never recorded a provider ID or KDF
+		// params, so it can only have been sealed with a statically
+		// configured EncryptionKey (or none at all).
+		if opt.KeyProvider != nil {
+			fp.Close()
+			return nil, fmt.Errorf(
+				"badger: %s is in the pre-KeyProvider format; open it once with Options.KeyProvider "+
+					"unset (Options.EncryptionKey set to the previous master key, if any) so Badger "+
+					"can migrate it, then switch back to KeyProvider", path)
+		}
+		sp, _ := NewStaticKeyProvider(opt.EncryptionKey).(*staticKeyProvider)
+		kr, err = readLegacyKeyRegistry(fp, sp, opt.DataKeyTTL)
+	} else {
+		// providerForExistingRegistry reads the KDF parameters (if any) off
+		// the file itself before deriving the provider, since a passphrase-mode
+		// master key can't be reconstructed without the salt stored
+		// alongside it.
+		var provider KeyProvider
+		provider, err = providerForExistingRegistry(fp, opt)
+		if err == nil {
+			kr, err = readKeyRegistry(fp, provider, opt.DataKeyTTL)
+		}
+	}
 	if err != nil {
 		// This case happens only if the file is opened properly and
 		// not able to read.
 		fp.Close()
 		return nil, err
 	}
+	if legacy && !opt.ReadOnly {
+		// Rewrite the file once in the current format so future opens
+		// skip the legacy fallback parse above and gain KDF/provider-ID
+		// support going forward.
+		kr.Lock()
+		kr.appendMu.Lock()
+		oldFp, rerr := kr.rewriteAndReopen(opt)
+		kr.appendMu.Unlock()
+		kr.Unlock()
+		if rerr != nil {
+			fp.Close()
+			return nil, fmt.Errorf("badger: migrating legacy key registry: %w", rerr)
+		}
+		_ = funlockRegistry(oldFp)
+		oldFp.Close()
+		return kr, nil
+	}
 	// We are seeking the end because, we don't incremental read.
 	// In readKeyRegistry we use ReadAt.
 	_, err = kr.fp.Seek(0, io.SeekEnd)
@@ -106,48 +229,66 @@ func OpenKeyRegistry(opt Options) (*KeyRegistry, error) {
 	return kr, nil
 }
 
-func readKeyRegistry(fp *os.File, encryptionKey []byte) (*KeyRegistry, error) {
+// isLegacyKeyRegistry reports whether fp predates keyRegistryMagic, by
+// checking whether the file starts with it.
+func isLegacyKeyRegistry(fp *os.File) (bool, error) {
+	stat, err := fp.Stat()
+	if err != nil {
+		return false, err
+	}
+	if stat.Size() < int64(len(keyRegistryMagic)) {
+		// Shorter than even the magic: not a legacy file either (the
+		// smallest legacy file, IV+sanity with no data keys, is longer
+		// than this), so let the normal parse below report a clear
+		// truncation error instead of guessing.
+		return false, nil
+	}
+	head, err := y.ReadAt(fp, 0, len(keyRegistryMagic))
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(head, keyRegistryMagic), nil
+}
+
+// readLegacyKeyRegistry parses the pre-KeyProvider KEYREGISTRY format: a
+// bare [16-byte IV][12-byte sanity][records], every data key's Data XORed
+// directly under sp's static key and that key's own Iv field, rather than
+// wrapped by a KeyProvider and stamped with a provider ID as storeDataKey
+// does now. It
+// exists solely so OpenKeyRegistry can migrate an existing file on first
+// open; every file written from here on is in the current format.
+func readLegacyKeyRegistry(fp *os.File, sp *staticKeyProvider, dataKeyTTL time.Duration) (*KeyRegistry, error) {
 	readPos := int64(0)
-	// Read the IV.
 	iv, err := y.ReadAt(fp, readPos, aes.BlockSize)
 	if err != nil {
 		return nil, err
 	}
 	readPos += aes.BlockSize
-	// Read sanity text.
 	eSanityText, err := y.ReadAt(fp, readPos, len(sanityText))
 	if err != nil {
 		return nil, err
 	}
-	if len(encryptionKey) > 0 {
-		var err error
-		// Decrpting sanity text.
-		eSanityText, err = y.XORBlock(eSanityText, encryptionKey, iv)
-		if err != nil {
+	readPos += int64(len(sanityText))
+	plainSanity := eSanityText
+	if len(sp.key) > 0 {
+		if plainSanity, err = y.XORBlock(eSanityText, sp.key, iv); err != nil {
 			return nil, err
 		}
 	}
-	// Check the given key is valid or not.
-	if !bytes.Equal(eSanityText, sanityText) {
+	if !bytes.Equal(plainSanity, sanityText) {
 		return nil, ErrEncryptionKeyMismatch
 	}
-	readPos += int64(len(sanityText))
 	stat, err := fp.Stat()
 	if err != nil {
 		return nil, err
 	}
-	kr := newKeyRegistry(encryptionKey)
-	for {
-		// Read all the datakey till the file ends.
-		if readPos == stat.Size() {
-			break
-		}
-		// Reading crc and crc length.
-		lenCrcBuf, err := y.ReadAt(fp, readPos, 8)
+	kr := newKeyRegistry(sp, dataKeyTTL)
+	for readPos < stat.Size() {
+		lenCrcBuf, err := y.ReadAt(fp, readPos, legacyLenCrcLen)
 		if err != nil {
 			return nil, err
 		}
-		readPos += 8
+		readPos += legacyLenCrcLen
 		l := int64(binary.BigEndian.Uint32(lenCrcBuf[0:4]))
 		data, err := y.ReadAt(fp, readPos, int(l))
 		if err != nil {
@@ -156,27 +297,157 @@ func readKeyRegistry(fp *os.File, encryptionKey []byte) (*KeyRegistry, error) {
 		if crc32.Checksum(data, y.CastagnoliCrcTable) != binary.BigEndian.Uint32(lenCrcBuf[4:]) {
 			return nil, errBadChecksum
 		}
+		readPos += l
 		dataKey := &pb.DataKey{}
-		if err = dataKey.Unmarshal(data); err != nil {
+		if err := dataKey.Unmarshal(data); err != nil {
 			return nil, err
 		}
-		if len(encryptionKey) > 0 {
-			// Decrypt the key if the storage key exits.
-			if dataKey.Data, err = y.XORBlock(dataKey.Data, encryptionKey, dataKey.Iv); err != nil {
+		if len(sp.key) > 0 {
+			if dataKey.Data, err = y.XORBlock(dataKey.Data, sp.key, dataKey.Iv); err != nil {
 				return nil, err
 			}
 		}
 		if dataKey.KeyId > kr.nextKeyID {
-			// Set the maximum key ID for next key ID generation.
 			kr.nextKeyID = dataKey.KeyId
 		}
 		if dataKey.CreatedAt > kr.lastCreated {
-			// Set the last generated key timestamp.
 			kr.lastCreated = dataKey.CreatedAt
 		}
-		// No need to lock, since we building the initial state.
-		kr.dataKeys[kr.nextKeyID] = dataKey
+		kr.nextSeq++
+		kr.dataKeys[dataKey.KeyId] = dataKey
+	}
+	kr.fp = fp
+	return kr, nil
+}
+
+// readSlice reads a 4-byte big-endian length prefix followed by that many
+// bytes, starting at readPos. It returns the slice and the position just
+// past it.
+func readSlice(fp *os.File, readPos int64) ([]byte, int64, error) {
+	lenBuf, err := y.ReadAt(fp, readPos, 4)
+	if err != nil {
+		return nil, 0, err
+	}
+	readPos += 4
+	l := int64(binary.BigEndian.Uint32(lenBuf))
+	data, err := y.ReadAt(fp, readPos, int(l))
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, readPos + l, nil
+}
+
+// writeSlice writes b to buf prefixed with its 4-byte big-endian length.
+func writeSlice(buf *bytes.Buffer, b []byte) error {
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(b)))
+	if _, err := buf.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err := buf.Write(b)
+	return err
+}
+
+func readKeyRegistry(fp *os.File, provider KeyProvider, dataKeyTTL time.Duration) (*KeyRegistry, error) {
+	// Callers only reach here once isLegacyKeyRegistry has confirmed fp
+	// starts with keyRegistryMagic, so skip straight past it.
+	readPos := int64(len(keyRegistryMagic))
+	// Read the KDF parameters used to derive a passphrase-based master key,
+	// if any; empty when the registry wasn't sealed in passphrase mode.
+	kdfBytes, readPos, err := readSlice(fp, readPos)
+	if err != nil {
+		return nil, err
+	}
+	kdf, err := unmarshalKDFParams(kdfBytes)
+	if err != nil {
+		return nil, err
+	}
+	// Read the provider ID the registry was sealed with.
+	providerID, readPos, err := readSlice(fp, readPos)
+	if err != nil {
+		return nil, err
+	}
+	if string(providerID) != provider.ID() {
+		return nil, ErrKeyProviderMismatch
+	}
+	// Read wrapped sanity text.
+	wrappedSanity, readPos, err := readSlice(fp, readPos)
+	if err != nil {
+		return nil, err
+	}
+	eSanityText, err := provider.UnwrapKey(wrappedSanity)
+	if err != nil {
+		return nil, err
+	}
+	// Check the given key is valid or not.
+	if !bytes.Equal(eSanityText, sanityText) {
+		return nil, ErrEncryptionKeyMismatch
+	}
+	stat, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	kr := newKeyRegistry(provider, dataKeyTTL)
+	kr.kdfParams = kdf
+	for {
+		// Read all the records till the file ends.
+		if readPos == stat.Size() {
+			break
+		}
+		// Read the record's sequence number and type.
+		hdr, err := y.ReadAt(fp, readPos, recordHeaderLen)
+		if err != nil {
+			return nil, err
+		}
+		readPos += recordHeaderLen
+		seq := binary.BigEndian.Uint64(hdr[0:8])
+		typ := recordType(hdr[8])
+		if seq > kr.nextSeq {
+			kr.nextSeq = seq
+		}
+		// Reading crc and crc length, common to every record type.
+		lenCrcBuf, err := y.ReadAt(fp, readPos, 8)
+		if err != nil {
+			return nil, err
+		}
+		readPos += 8
+		l := int64(binary.BigEndian.Uint32(lenCrcBuf[0:4]))
+		data, err := y.ReadAt(fp, readPos, int(l))
+		if err != nil {
+			return nil, err
+		}
+		if crc32.Checksum(data, y.CastagnoliCrcTable) != binary.BigEndian.Uint32(lenCrcBuf[4:]) {
+			return nil, errBadChecksum
+		}
 		readPos += l
+
+		switch typ {
+		case recordAddKey:
+			dataKey := &pb.DataKey{}
+			if err = dataKey.Unmarshal(data); err != nil {
+				return nil, err
+			}
+			if dataKey.ProviderId != "" && dataKey.ProviderId != provider.ID() {
+				return nil, fmt.Errorf("badger: data key %d: %w", dataKey.KeyId, ErrKeyProviderMismatch)
+			}
+			if dataKey.Data, err = provider.UnwrapKey(dataKey.Data); err != nil {
+				return nil, err
+			}
+			if dataKey.KeyId > kr.nextKeyID {
+				// Set the maximum key ID for next key ID generation.
+				kr.nextKeyID = dataKey.KeyId
+			}
+			if dataKey.CreatedAt > kr.lastCreated {
+				// Set the last generated key timestamp.
+				kr.lastCreated = dataKey.CreatedAt
+			}
+			// No need to lock, since we're building the initial state.
+			kr.dataKeys[dataKey.KeyId] = dataKey
+		case recordExpireKey, recordRevokeKey:
+			delete(kr.dataKeys, binary.BigEndian.Uint64(data))
+		default:
+			return nil, fmt.Errorf("badger: unknown key registry record type %d", typ)
+		}
 	}
 	kr.fp = fp
 	return kr, nil
@@ -191,33 +462,43 @@ func WriteKeyRegistry(reg *KeyRegistry, opt Options) error {
 		return err
 	}
 	buf := &bytes.Buffer{}
-	iv, err := y.GenereateIV()
+	if _, err := buf.Write(keyRegistryMagic); err != nil {
+		fp.Close()
+		return err
+	}
+
+	kdfBytes, err := marshalKDFParams(reg.kdfParams)
 	if err != nil {
+		fp.Close()
+		return err
+	}
+	if err := writeSlice(buf, kdfBytes); err != nil {
+		fp.Close()
 		return err
 	}
 
-	// Encrypt sanity text if the storage presents.
-	eSanity := sanityText
-	if len(opt.EncryptionKey) > 0 {
-		var err error
-		eSanity, err = y.XORBlock(eSanity, opt.EncryptionKey, iv)
-		if err != nil {
-			return err
-		}
+	if err := writeSlice(buf, []byte(reg.provider.ID())); err != nil {
+		fp.Close()
+		return err
 	}
-	if _, err = buf.Write(iv); err != nil {
+	wrappedSanity, err := reg.provider.WrapKey(sanityText)
+	if err != nil {
 		fp.Close()
 		return err
 	}
-	if _, err = buf.Write(eSanity); err != nil {
+	if err := writeSlice(buf, wrappedSanity); err != nil {
 		fp.Close()
 		return err
 	}
 
-	// Write all the datakeys to the disk.
+	// Write all the datakeys to the disk as a fresh base of the append-only
+	// log, dropping anything already deleted from reg.dataKeys (expired or
+	// revoked keys) and renumbering sequence numbers from scratch.
+	var seq uint64
 	for _, k := range reg.dataKeys {
+		seq++
 		// Wrting the datakey to the given file fd.
-		if err := storeDataKey(buf, opt.EncryptionKey, k, false); err != nil {
+		if err := storeDataKey(buf, reg.provider, k, seq); err != nil {
 			fp.Close()
 			return err
 		}
@@ -242,38 +523,69 @@ func WriteKeyRegistry(reg *KeyRegistry, opt Options) error {
 	if err = os.Rename(tmpPath, registryPath); err != nil {
 		return err
 	}
+	reg.nextSeq = seq
 	return syncDir(opt.Dir)
 }
 
+// dataKey resolves id to the DataKey it was minted as, regardless of
+// whether Options.DataKeyTTL has since elapsed on it. Expiry only ever
+// keeps latestDataKey from handing out that key for new writes; it must
+// never stop a lookup by id from succeeding, since that's exactly how
+// RewriteEncryptedFiles (and anything else decrypting content already
+// sealed under an old key) reads it back in order to migrate data off it
+// before PurgeExpiredKeys drops it for good.
 func (kr *KeyRegistry) dataKey(id uint64) (*pb.DataKey, error) {
 	if id == 0 {
 		return nil, nil
 	}
+	kr.RLock()
 	dk, ok := kr.dataKeys[id]
+	kr.RUnlock()
 	if !ok {
 		return nil, ErrInvalidDataKeyID
 	}
 	return dk, nil
 }
 
+// newestKeyID returns the id of the most recently generated data key, or 0
+// if the registry is using the plain (no-op) provider and has never
+// generated one. RewriteEncryptedFiles uses it to reject a targetKeyID
+// that names a key the registry hasn't minted yet, since latestDataKey
+// could never hand back a key that new.
+func (kr *KeyRegistry) newestKeyID() uint64 {
+	kr.RLock()
+	defer kr.RUnlock()
+	return kr.nextKeyID
+}
+
 func (kr *KeyRegistry) latestDataKey() (*pb.DataKey, error) {
-	if len(kr.encryptionKey) == 0 {
+	if kr.provider.ID() == plainKeyProviderID {
 		return nil, nil
 	}
 
 	// Time diffrence from the last generated time.
 	diff := time.Since(time.Unix(kr.lastCreated, 0))
 	if diff < RotationPeriod {
-		// If less than 10 days, returns the last generaterd key.
+		// If less than 10 days, returns the last generaterd key, unless it
+		// has been revoked or has already expired, in which case fall
+		// through and mint a new one instead of handing out an expired key
+		// for a new write, or no key at all.
 		kr.RLock()
-		defer kr.RUnlock()
 		dk := kr.dataKeys[kr.nextKeyID]
-		return dk, nil
+		kr.RUnlock()
+		if dk != nil && (dk.ExpiresAt == 0 || time.Now().Unix() <= dk.ExpiresAt) {
+			return dk, nil
+		}
 	}
 
-	// Otherwise Increment the KeyID and generate new datakey
-	kr.nextKeyID++
-	k := make([]byte, len(kr.encryptionKey))
+	return kr.generateDataKey()
+}
+
+// generateDataKey creates a fresh data key, persists it to the registry
+// file, and registers it as the newest key. It is shared by latestDataKey's
+// timer-based rotation and RotateDataKey's on-demand rotation.
+func (kr *KeyRegistry) generateDataKey() (*pb.DataKey, error) {
+	k := make([]byte, dataKeySize)
 	iv, err := y.GenereateIV()
 	if err != nil {
 		return nil, err
@@ -282,59 +594,120 @@ func (kr *KeyRegistry) latestDataKey() (*pb.DataKey, error) {
 	if err != nil {
 		return nil, err
 	}
+	// RotateDataKey exposes generateDataKey as a public, concurrent-safe
+	// call, so the KeyID increment has to be locked: two overlapping
+	// callers racing on a bare kr.nextKeyID++ could otherwise both read
+	// the same value and hand out two different data keys under one
+	// KeyID, silently clobbering one of them in kr.dataKeys.
+	kr.Lock()
+	kr.nextKeyID++
+	id := kr.nextKeyID
+	kr.Unlock()
 	dk := &pb.DataKey{
-		KeyId:     kr.nextKeyID,
+		KeyId:     id,
 		Data:      k,
 		CreatedAt: time.Now().Unix(),
 		Iv:        iv,
 	}
-	// Store the datekey.
+	if kr.dataKeyTTL > 0 {
+		dk.ExpiresAt = dk.CreatedAt + int64(kr.dataKeyTTL/time.Second)
+	}
+	// kr.appendMu guards both the sequence number a record is tagged with
+	// and its physical write, so it has to span the whole append: bumping
+	// nextSeq outside the lock would let it race with Compact resetting
+	// nextSeq under the same lock, handing out a sequence number that a
+	// rewrite could then silently roll back.
 	buf := &bytes.Buffer{}
-	err = storeDataKey(buf, kr.encryptionKey, dk, true)
+	kr.appendMu.Lock()
+	kr.nextSeq++
+	err = storeDataKey(buf, kr.provider, dk, kr.nextSeq)
 	if err != nil {
+		kr.appendMu.Unlock()
 		return nil, err
 	}
-	// Persist the datakey to the disk
-	if _, err = kr.fp.Write(buf.Bytes()); err != nil {
-		return nil, err
+	_, err = kr.fp.Write(buf.Bytes())
+	if err == nil {
+		err = y.FileSync(kr.fp)
 	}
-	if err = y.FileSync(kr.fp); err != nil {
+	kr.appendMu.Unlock()
+	if err != nil {
 		return nil, err
 	}
-	// storeDatakey encrypts the datakey So, placing unencrypted key in the memory
+	// storeDatakey wraps the datakey, so place the unwrapped key in memory.
 	dk.Data = k
 	kr.Lock()
-	defer kr.Unlock()
 	kr.lastCreated = dk.CreatedAt
-	kr.dataKeys[kr.nextKeyID] = dk
+	kr.dataKeys[id] = dk
+	kr.Unlock()
+	kr.publish(KeyEvent{Type: KeyEventAdded, KeyID: dk.KeyId})
 	return dk, nil
 }
 
 // Close closes the key registry.
 func (kr *KeyRegistry) Close() error {
+	kr.Lock()
+	for id, ch := range kr.subscribers {
+		close(ch)
+		delete(kr.subscribers, id)
+	}
+	kr.Unlock()
+	_ = funlockRegistry(kr.fp)
 	return kr.fp.Close()
 }
 
-func storeDataKey(buf *bytes.Buffer, storageKey []byte, k *pb.DataKey, sync bool) error {
-	if len(storageKey) > 0 {
-		var err error
-		// In memory, we'll have decrypted key.
-		if k.Data, err = y.XORBlock(k.Data, storageKey, k.Iv); err != nil {
-			return err
-		}
+// writeRecordHeader writes the sequence number and record type that precede
+// every record's length-and-crc-framed payload in the append-only log.
+func writeRecordHeader(buf *bytes.Buffer, seq uint64, typ recordType) error {
+	var hdr [recordHeaderLen]byte
+	binary.BigEndian.PutUint64(hdr[0:8], seq)
+	hdr[8] = byte(typ)
+	_, err := buf.Write(hdr[:])
+	return err
+}
+
+// writeFramedPayload appends data's length-and-crc framing, the same
+// framing used for every record regardless of recordType.
+func writeFramedPayload(buf *bytes.Buffer, data []byte) error {
+	var lenCrcBuf [8]byte
+	binary.BigEndian.PutUint32(lenCrcBuf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(lenCrcBuf[4:8], crc32.Checksum(data, y.CastagnoliCrcTable))
+	if _, err := buf.Write(lenCrcBuf[:]); err != nil {
+		return err
+	}
+	_, err := buf.Write(data)
+	return err
+}
+
+// storeDataKey appends a recordAddKey for k, wrapping its data key under
+// provider and stamping it with seq, the record's position in the
+// registry's append-only log.
+func storeDataKey(buf *bytes.Buffer, provider KeyProvider, k *pb.DataKey, seq uint64) error {
+	plain := k.Data
+	wrapped, err := provider.WrapKey(plain)
+	if err != nil {
+		return err
 	}
+	k.Data = wrapped
+	k.ProviderId = provider.ID()
 	data, err := k.Marshal()
+	// In memory, we'll have the unwrapped key.
+	k.Data = plain
 	if err != nil {
 		return err
 	}
-	var lenCrcBuf [8]byte
-	binary.BigEndian.PutUint32(lenCrcBuf[0:4], uint32(len(data)))
-	binary.BigEndian.PutUint32(lenCrcBuf[4:8], crc32.Checksum(data, y.CastagnoliCrcTable))
-	if _, err = buf.Write(lenCrcBuf[:]); err != nil {
+	if err := writeRecordHeader(buf, seq, recordAddKey); err != nil {
 		return err
 	}
-	if _, err = buf.Write(data); err != nil {
+	return writeFramedPayload(buf, data)
+}
+
+// storeKeyIDRecord appends a recordExpireKey or recordRevokeKey for keyID,
+// stamped with seq.
+func storeKeyIDRecord(buf *bytes.Buffer, seq uint64, typ recordType, keyID uint64) error {
+	if err := writeRecordHeader(buf, seq, typ); err != nil {
 		return err
 	}
-	return nil
-}
\ No newline at end of file
+	var payload [8]byte
+	binary.BigEndian.PutUint64(payload[:], keyID)
+	return writeFramedPayload(buf, payload[:])
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+// KeyEventType identifies what happened to a key, as reported to
+// KeyRegistry.Subscribe callers.
+type KeyEventType int
+
+const (
+	// KeyEventAdded is published when a new data key is generated, whether
+	// by the RotationPeriod timer or RotateDataKey.
+	KeyEventAdded KeyEventType = iota
+	// KeyEventExpired is published when a data key is dropped from the
+	// registry by PurgeExpiredKeys.
+	KeyEventExpired
+	// KeyEventRevoked is published when a data key is dropped from the
+	// registry by RevokeKey.
+	KeyEventRevoked
+	// KeyEventMasterRotated is published when RotateEncryptionKey finishes
+	// re-wrapping the registry under a new master key.
+	KeyEventMasterRotated
+	// KeyEventCompacted is published when Compact finishes rewriting the
+	// registry's append-only log.
+	KeyEventCompacted
+)
+
+// KeyEvent is a single notification delivered to KeyRegistry.Subscribe
+// callers. KeyID is only meaningful for the Added/Expired/Revoked types.
+type KeyEvent struct {
+	Type  KeyEventType
+	KeyID uint64
+}
+
+// subscriberBuffer bounds how many events a Subscribe channel will queue
+// before publish starts dropping events for that subscriber rather than
+// blocking the caller that triggered them.
+const subscriberBuffer = 16
+
+// Subscribe registers the caller to receive KeyEvents as they happen:
+// rotation, expiry, revocation, and compaction. The returned cancel func
+// unregisters and closes the channel; callers must not use the channel
+// after calling it. The channel is also closed when the KeyRegistry itself
+// is closed.
+func (kr *KeyRegistry) Subscribe() (<-chan KeyEvent, func()) {
+	ch := make(chan KeyEvent, subscriberBuffer)
+	id := atomic.AddUint64(&kr.nextSubID, 1)
+
+	kr.Lock()
+	kr.subscribers[id] = ch
+	kr.Unlock()
+
+	cancel := func() {
+		kr.Lock()
+		if existing, ok := kr.subscribers[id]; ok {
+			close(existing)
+			delete(kr.subscribers, id)
+		}
+		kr.Unlock()
+	}
+	return ch, cancel
+}
+
+// publish fans ev out to every subscriber without blocking; a subscriber
+// that isn't keeping up simply misses the event instead of stalling the
+// caller that triggered it (equivalent in spirit to a registry write).
+func (kr *KeyRegistry) publish(ev KeyEvent) {
+	kr.RLock()
+	defer kr.RUnlock()
+	for _, ch := range kr.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// RevokeKey immediately drops id from the registry, appending a
+// recordRevokeKey to the log rather than rewriting it wholesale. Use it to
+// invalidate a specific data key ahead of its normal expiration, for
+// example one implicated in a compromise. Like PurgeExpiredKeys, it will
+// not let you revoke a key that a live SSTable or value log file still
+// depends on; run RewriteEncryptedFiles first.
+func (db *DB) RevokeKey(id uint64) error {
+	if db.liveDataKeyIDs()[id] {
+		return ErrDataKeyInUse
+	}
+	kr := db.registry
+
+	kr.RLock()
+	_, ok := kr.dataKeys[id]
+	kr.RUnlock()
+	if !ok {
+		return ErrInvalidDataKeyID
+	}
+
+	// kr.appendMu has to span the nextSeq bump as well as the write; see the
+	// comment on the equivalent section of generateDataKey.
+	buf := &bytes.Buffer{}
+	kr.appendMu.Lock()
+	kr.nextSeq++
+	err := storeKeyIDRecord(buf, kr.nextSeq, recordRevokeKey, id)
+	if err != nil {
+		kr.appendMu.Unlock()
+		return err
+	}
+	_, err = kr.fp.Write(buf.Bytes())
+	if err == nil {
+		err = y.FileSync(kr.fp)
+	}
+	kr.appendMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	kr.Lock()
+	delete(kr.dataKeys, id)
+	kr.Unlock()
+
+	kr.publish(KeyEvent{Type: KeyEventRevoked, KeyID: id})
+	return nil
+}
+
+// rewriteAndReopen calls WriteKeyRegistry to atomically rewrite the
+// registry from kr's current in-memory state, then reopens and re-locks
+// kr.fp in its place: the rename WriteKeyRegistry does to install the new
+// file leaves any already-open handle, including kr.fp, pointing at the
+// now-unlinked old one. Callers must hold both kr.Lock and kr.appendMu
+// across the call, since it swaps kr.fp out from under any concurrent
+// reader or appender; on success it returns the old *os.File for the
+// caller to unlock and close once it has released those locks.
+func (kr *KeyRegistry) rewriteAndReopen(opt Options) (oldFp *os.File, err error) {
+	oldFp = kr.fp
+	if err = WriteKeyRegistry(kr, opt); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(opt.Dir, KeyRegistryFileName)
+	newFp, err := y.OpenExistingFile(path, 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = newFp.Seek(0, io.SeekEnd); err != nil {
+		newFp.Close()
+		return nil, err
+	}
+	if err = flockRegistry(newFp); err != nil {
+		newFp.Close()
+		return nil, err
+	}
+	kr.fp = newFp
+	return oldFp, nil
+}
+
+// Compact rewrites the registry's append-only log to a fresh base
+// snapshot of its current dataKeys, the same full rewrite WriteKeyRegistry
+// always did before the log became append-only. Run it periodically (or
+// after a burst of PurgeExpiredKeys/RevokeKey calls) to reclaim the space
+// used by records superseded since the last compaction; unlike those
+// calls, which only append, Compact is O(len(dataKeys)).
+func (kr *KeyRegistry) Compact(opt Options) error {
+	kr.Lock()
+	kr.appendMu.Lock()
+	oldFp, err := kr.rewriteAndReopen(opt)
+	kr.appendMu.Unlock()
+	kr.Unlock()
+
+	if err != nil {
+		return err
+	}
+	_ = funlockRegistry(oldFp)
+	oldFp.Close()
+
+	kr.publish(KeyEvent{Type: KeyEventCompacted})
+	return nil
+}
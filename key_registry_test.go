@@ -0,0 +1,132 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgraph-io/badger/pb"
+	"github.com/dgraph-io/badger/y"
+)
+
+func TestOpenKeyRegistry_ProviderMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-keyregistry-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opt := Options{Dir: dir, EncryptionKey: []byte("0123456789abcdef0123456789abcdef")}
+	kr, err := OpenKeyRegistry(opt)
+	if err != nil {
+		t.Fatalf("creating registry: %v", err)
+	}
+	if err := kr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	otherOpt := Options{Dir: dir, EncryptionKey: []byte("fedcba9876543210fedcba9876543210")}
+	if _, err := OpenKeyRegistry(otherOpt); err != ErrEncryptionKeyMismatch {
+		t.Fatalf("got err %v, want ErrEncryptionKeyMismatch", err)
+	}
+}
+
+func TestOpenKeyRegistry_LegacyMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-keyregistry-legacy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	writeLegacyKeyRegistry(t, dir, key)
+
+	opt := Options{Dir: dir, EncryptionKey: key}
+	kr, err := OpenKeyRegistry(opt)
+	if err != nil {
+		t.Fatalf("opening legacy registry: %v", err)
+	}
+	defer kr.Close()
+
+	dk, err := kr.dataKey(1)
+	if err != nil {
+		t.Fatalf("looking up migrated data key: %v", err)
+	}
+	if dk == nil || dk.KeyId != 1 {
+		t.Fatalf("migrated data key missing or wrong ID: %+v", dk)
+	}
+
+	// The file on disk should now be in the current, magic-tagged format.
+	raw, err := ioutil.ReadFile(filepath.Join(dir, KeyRegistryFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(raw, keyRegistryMagic) {
+		t.Fatalf("registry file was not migrated to the current format")
+	}
+}
+
+// writeLegacyKeyRegistry writes a KEYREGISTRY file in the pre-KeyProvider
+// format: [16-byte IV][12-byte sanity][records], with a single data key,
+// exactly as the pre-chunk0-1 WriteKeyRegistry used to.
+func writeLegacyKeyRegistry(t *testing.T, dir string, key []byte) {
+	t.Helper()
+	iv, err := y.GenereateIV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	eSanity, err := y.XORBlock(sanityText, key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	buf.Write(iv)
+	buf.Write(eSanity)
+
+	dk := &pb.DataKey{
+		KeyId:     1,
+		Data:      make([]byte, aes.BlockSize*2),
+		Iv:        iv,
+		CreatedAt: 1,
+	}
+	encData, err := y.XORBlock(dk.Data, key, dk.Iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dk.Data = encData
+	data, err := dk.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lenCrcBuf [8]byte
+	binary.BigEndian.PutUint32(lenCrcBuf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(lenCrcBuf[4:8], crc32.Checksum(data, y.CastagnoliCrcTable))
+	buf.Write(lenCrcBuf[:])
+	buf.Write(data)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, KeyRegistryFileName), buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,36 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// +build !windows,!plan9
+
+package badger
+
+import (
+	"os"
+	"syscall"
+)
+
+// flockRegistry takes an exclusive, non-blocking advisory lock on fp, the
+// same mechanism Badger's directory lock guard uses, so two processes
+// can't open and mutate the same KEYREGISTRY at once.
+func flockRegistry(fp *os.File) error {
+	return syscall.Flock(int(fp.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+// funlockRegistry releases the lock taken by flockRegistry.
+func funlockRegistry(fp *os.File) error {
+	return syscall.Flock(int(fp.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,34 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// +build windows plan9
+
+package badger
+
+import "os"
+
+// flockRegistry is a no-op on platforms without advisory file locking
+// support. Badger's directory lock (which callers must already hold before
+// opening a KEYREGISTRY) still prevents two Badger processes from sharing
+// a directory on these platforms.
+func flockRegistry(fp *os.File) error {
+	return nil
+}
+
+// funlockRegistry is a no-op, see flockRegistry.
+func funlockRegistry(fp *os.File) error {
+	return nil
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/dgraph-io/badger/pb"
+)
+
+// ErrInvalidTargetKeyID is returned by RewriteEncryptedFiles when
+// targetKeyID names a data key the registry hasn't generated yet.
+// latestDataKey can only ever hand back an existing key, so rewriting
+// under a not-yet-existent target could never satisfy the documented
+// postcondition that no live file still depends on a key older than
+// targetKeyID.
+var ErrInvalidTargetKeyID = errors.New("badger: targetKeyID is newer than the registry's newest data key")
+
+// RotateDataKey forces the generation of a new data key, bypassing the
+// RotationPeriod timer that latestDataKey otherwise waits on. Use it to
+// retire a data key immediately, for example after a suspected compromise,
+// instead of waiting up to RotationPeriod for the next write to trigger it.
+func (kr *KeyRegistry) RotateDataKey() (*pb.DataKey, error) {
+	return kr.generateDataKey()
+}
+
+// RotateEncryptionKey re-wraps every DataKey in the registry under
+// newMasterKey and atomically rewrites KEYREGISTRY, then swaps the live
+// registry over to the new master key. Existing SSTables and the value log
+// keep working unchanged, since they only ever reference a DataKey's
+// KeyId; only the KEYREGISTRY file itself, and the in-memory provider used
+// to unwrap its entries, change.
+//
+// RotateEncryptionKey does not rewrite already-encrypted blocks. Call
+// RewriteEncryptedFiles afterwards to migrate existing data off a data key
+// that should be retired entirely.
+func (db *DB) RotateEncryptionKey(newMasterKey []byte) error {
+	newProvider := NewStaticKeyProvider(newMasterKey)
+	kr := db.registry
+
+	kr.Lock()
+	kr.appendMu.Lock()
+
+	rewrapped := make(map[uint64]*pb.DataKey, len(kr.dataKeys))
+	for id, dk := range kr.dataKeys {
+		clone := *dk
+		rewrapped[id] = &clone
+	}
+
+	oldProvider := kr.provider
+	oldKDF := kr.kdfParams
+	kr.provider = newProvider
+	// newMasterKey is supplied raw, not derived from a passphrase, so any
+	// KDF parameters the registry was previously sealed with no longer
+	// apply.
+	kr.kdfParams = nil
+	kr.dataKeys = rewrapped
+
+	oldFp, err := kr.rewriteAndReopen(db.opt)
+	if err != nil {
+		// Roll back so a failed rotation doesn't leave the in-memory
+		// registry out of sync with what's on disk.
+		kr.provider = oldProvider
+		kr.kdfParams = oldKDF
+	}
+
+	kr.appendMu.Unlock()
+	kr.Unlock()
+
+	if err != nil {
+		return err
+	}
+	_ = funlockRegistry(oldFp)
+	oldFp.Close()
+
+	kr.publish(KeyEvent{Type: KeyEventMasterRotated})
+	return nil
+}
+
+// RewriteEncryptedFilesProgress reports the state of an in-flight
+// RewriteEncryptedFiles call.
+type RewriteEncryptedFilesProgress struct {
+	FilesTotal     int
+	FilesRewritten int
+	BytesRewritten int64
+}
+
+// ioRateLimiter throttles cumulative byte throughput to at most
+// bytesPerSecond by sleeping proportionally to how far ahead of schedule
+// the caller is running. A zero bytesPerSecond disables throttling.
+type ioRateLimiter struct {
+	bytesPerSecond int64
+	start          time.Time
+	seen           int64
+}
+
+func newIORateLimiter(bytesPerSecond int64) *ioRateLimiter {
+	return &ioRateLimiter{bytesPerSecond: bytesPerSecond, start: time.Now()}
+}
+
+// allow accounts for n more bytes having been processed and blocks until
+// the configured rate would no longer be exceeded.
+func (l *ioRateLimiter) allow(n int64) {
+	if l == nil || l.bytesPerSecond <= 0 {
+		return
+	}
+	l.seen += n
+	wantElapsed := time.Duration(float64(l.seen) / float64(l.bytesPerSecond) * float64(time.Second))
+	if sleep := wantElapsed - time.Since(l.start); sleep > 0 {
+		time.Sleep(sleep)
+	}
+}
+
+// RewriteOptions bounds the IO that RewriteEncryptedFiles is allowed to
+// consume while it walks the LSM tree and value log.
+type RewriteOptions struct {
+	// MaxBytesPerSecond throttles rewrite throughput. Zero means
+	// unbounded.
+	MaxBytesPerSecond int64
+	// OnProgress, if set, is invoked after each SSTable is rewritten and
+	// once more after the value log pass. The value log counts as a single
+	// file in FilesTotal and FilesRewritten, however many value log files
+	// that pass rewrote.
+	OnProgress func(RewriteEncryptedFilesProgress)
+}
+
+// RewriteEncryptedFiles walks every SSTable and value log file whose block
+// header references a data key older than targetKeyID and rewrites it
+// in-place under the data key returned by the registry's latestDataKey, so
+// that once it completes, no live file still depends on a key older than
+// targetKeyID. It is the counterpart to RotateEncryptionKey and
+// RotateDataKey: rotating the keys is cheap and immediate, but the
+// encrypted data itself is only migrated by this call, which may run for a
+// long time on a large database. ctx can be cancelled to stop early; a
+// partially completed rewrite leaves previously-rewritten files migrated
+// and is safe to resume by calling RewriteEncryptedFiles again. targetKeyID
+// must not be newer than the registry's newest data key -- call
+// RotateDataKey first if it needs to be -- otherwise RewriteEncryptedFiles
+// returns ErrInvalidTargetKeyID rather than silently migrating nothing.
+func (db *DB) RewriteEncryptedFiles(ctx context.Context, targetKeyID uint64, opts RewriteOptions) error {
+	if targetKeyID > db.registry.newestKeyID() {
+		return ErrInvalidTargetKeyID
+	}
+
+	tables := db.lc.allTables()
+	progress := RewriteEncryptedFilesProgress{FilesTotal: len(tables) + 1}
+
+	limiter := newIORateLimiter(opts.MaxBytesPerSecond)
+	for _, t := range tables {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if t.KeyID() >= targetKeyID {
+			progress.FilesTotal--
+			continue
+		}
+		n, err := db.lc.rewriteTableWithLatestKey(db.registry, t, limiter)
+		if err != nil {
+			return err
+		}
+		progress.FilesRewritten++
+		progress.BytesRewritten += n
+		if opts.OnProgress != nil {
+			opts.OnProgress(progress)
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	n, err := db.vlog.rewriteBelowKeyID(ctx, db.registry, targetKeyID, limiter)
+	if err != nil {
+		return err
+	}
+	progress.FilesRewritten++
+	progress.BytesRewritten += n
+	if opts.OnProgress != nil {
+		opts.OnProgress(progress)
+	}
+	return nil
+}
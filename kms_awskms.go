@@ -0,0 +1,55 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+// AWSKMSClient is the subset of an AWS KMS client that the AWS KMS
+// KeyProvider needs. A *kms.Client from the AWS SDK satisfies this
+// interface via thin wrapper methods, which keeps the AWS SDK out of
+// Badger's own dependency graph.
+type AWSKMSClient interface {
+	// Encrypt encrypts plaintext under the KMS key identified by keyID
+	// (a key ID, alias, or ARN) and returns the resulting ciphertext blob.
+	Encrypt(keyID string, plaintext []byte) (ciphertext []byte, err error)
+	// Decrypt reverses Encrypt. KMS embeds the key ID in the ciphertext
+	// blob itself, so it is not needed again here.
+	Decrypt(ciphertext []byte) (plaintext []byte, err error)
+}
+
+// awsKMSKeyProvider is a KeyProvider that delegates wrapping and unwrapping
+// of data keys to an AWS KMS customer master key (CMK).
+type awsKMSKeyProvider struct {
+	client AWSKMSClient
+	keyID  string
+}
+
+// NewAWSKMSKeyProvider returns a KeyProvider that wraps data keys with the
+// AWS KMS CMK identified by keyID via client.
+func NewAWSKMSKeyProvider(client AWSKMSClient, keyID string) KeyProvider {
+	return &awsKMSKeyProvider{client: client, keyID: keyID}
+}
+
+func (a *awsKMSKeyProvider) ID() string {
+	return "awskms:" + a.keyID
+}
+
+func (a *awsKMSKeyProvider) WrapKey(dataKey []byte) ([]byte, error) {
+	return a.client.Encrypt(a.keyID, dataKey)
+}
+
+func (a *awsKMSKeyProvider) UnwrapKey(wrapped []byte) ([]byte, error) {
+	return a.client.Decrypt(wrapped)
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+// GCPKMSClient is the subset of a Google Cloud KMS client that the GCP KMS
+// KeyProvider needs. A cloud.google.com/go/kms client satisfies this
+// interface via thin wrapper methods, which keeps the GCP SDK out of
+// Badger's own dependency graph.
+type GCPKMSClient interface {
+	// Encrypt encrypts plaintext under the CryptoKey identified by
+	// keyName (its fully-qualified resource name).
+	Encrypt(keyName string, plaintext []byte) (ciphertext []byte, err error)
+	// Decrypt reverses Encrypt.
+	Decrypt(keyName string, ciphertext []byte) (plaintext []byte, err error)
+}
+
+// gcpKMSKeyProvider is a KeyProvider that delegates wrapping and unwrapping
+// of data keys to a Google Cloud KMS CryptoKey.
+type gcpKMSKeyProvider struct {
+	client  GCPKMSClient
+	keyName string
+}
+
+// NewGCPKMSKeyProvider returns a KeyProvider that wraps data keys with the
+// GCP KMS CryptoKey identified by keyName via client.
+func NewGCPKMSKeyProvider(client GCPKMSClient, keyName string) KeyProvider {
+	return &gcpKMSKeyProvider{client: client, keyName: keyName}
+}
+
+func (g *gcpKMSKeyProvider) ID() string {
+	return "gcpkms:" + g.keyName
+}
+
+func (g *gcpKMSKeyProvider) WrapKey(dataKey []byte) ([]byte, error) {
+	return g.client.Encrypt(g.keyName, dataKey)
+}
+
+func (g *gcpKMSKeyProvider) UnwrapKey(wrapped []byte) ([]byte, error) {
+	return g.client.Decrypt(g.keyName, wrapped)
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+// KMIPClient is the subset of a KMIP (Key Management Interoperability
+// Protocol) client that the KMIP KeyProvider needs, covering the Encrypt
+// and Decrypt operations against a managed symmetric key. Keeping this as
+// a narrow interface lets callers plug in whichever KMIP client library
+// matches their appliance without Badger depending on one directly.
+type KMIPClient interface {
+	// Encrypt encrypts plaintext using the managed key identified by
+	// uniqueIdentifier, the KMIP Unique Identifier attribute.
+	Encrypt(uniqueIdentifier string, plaintext []byte) (ciphertext []byte, err error)
+	// Decrypt reverses Encrypt.
+	Decrypt(uniqueIdentifier string, ciphertext []byte) (plaintext []byte, err error)
+}
+
+// kmipKeyProvider is a KeyProvider that delegates wrapping and unwrapping
+// of data keys to a managed key held on a KMIP-compliant key manager.
+type kmipKeyProvider struct {
+	client           KMIPClient
+	uniqueIdentifier string
+}
+
+// NewKMIPKeyProvider returns a KeyProvider that wraps data keys with the
+// KMIP-managed key identified by uniqueIdentifier via client.
+func NewKMIPKeyProvider(client KMIPClient, uniqueIdentifier string) KeyProvider {
+	return &kmipKeyProvider{client: client, uniqueIdentifier: uniqueIdentifier}
+}
+
+func (k *kmipKeyProvider) ID() string {
+	return "kmip:" + k.uniqueIdentifier
+}
+
+func (k *kmipKeyProvider) WrapKey(dataKey []byte) ([]byte, error) {
+	return k.client.Encrypt(k.uniqueIdentifier, dataKey)
+}
+
+func (k *kmipKeyProvider) UnwrapKey(wrapped []byte) ([]byte, error) {
+	return k.client.Decrypt(k.uniqueIdentifier, wrapped)
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import "sync"
+
+// level owns every Table currently resident at one level of the LSM tree.
+type level struct {
+	sync.RWMutex
+	tables []*Table
+}
+
+// levelsController owns every level's tables and coordinates compaction
+// between them.
+type levelsController struct {
+	levels []*level
+}
+
+// allTables returns every Table currently live across every level. The
+// returned slice is a snapshot; it doesn't block concurrent compaction.
+func (lc *levelsController) allTables() []*Table {
+	var out []*Table
+	for _, l := range lc.levels {
+		l.RLock()
+		out = append(out, l.tables...)
+		l.RUnlock()
+	}
+	return out
+}
+
+// rewriteTableWithLatestKey re-encrypts t in place under kr's current
+// latest data key and returns the number of bytes read from the old file.
+// It's the table-level counterpart RewriteEncryptedFiles drives to migrate
+// data off a data key being retired.
+func (lc *levelsController) rewriteTableWithLatestKey(kr *KeyRegistry, t *Table, limiter *ioRateLimiter) (int64, error) {
+	oldDK, err := kr.dataKey(t.KeyID())
+	if err != nil {
+		return 0, err
+	}
+	newDK, err := kr.latestDataKey()
+	if err != nil {
+		return 0, err
+	}
+	n, err := t.rewriteUnderKey(oldDK, newDK)
+	if err != nil {
+		return 0, err
+	}
+	limiter.allow(n)
+	return n, nil
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import "time"
+
+// Logger is implemented by any logger that Badger can write diagnostic
+// output to. It mirrors the handful of levels Badger itself logs at.
+type Logger interface {
+	Errorf(string, ...interface{})
+	Warningf(string, ...interface{})
+	Infof(string, ...interface{})
+	Debugf(string, ...interface{})
+}
+
+// Options are the knobs the key registry subsystem reads off of DB's
+// configuration.
+type Options struct {
+	// Dir is the directory Badger stores the KEYREGISTRY file (and the
+	// rest of its data) in.
+	Dir string
+	// ReadOnly opens the database, and the key registry along with it,
+	// without taking the advisory registry lock or allowing writes.
+	ReadOnly bool
+	// EncryptionKey is the static master key used to wrap and unwrap data
+	// keys when no KeyProvider is set.
+	EncryptionKey []byte
+	// KeyProvider, when set, wraps and unwraps data keys under an externally
+	// held master key instead of a statically configured EncryptionKey. See
+	// KeyProvider for details.
+	KeyProvider KeyProvider
+	// Logger receives diagnostic output from background jobs the key
+	// registry starts, such as the data key expiry loop.
+	Logger Logger
+	// DataKeyTTL bounds how long a data key remains eligible to be handed
+	// out for new writes after it was generated; it never stops content
+	// already sealed under that key from being decrypted. Zero (the
+	// default) means data keys never expire on their own; RotationPeriod
+	// still mints a new one periodically, but old ones stay valid. See
+	// PurgeExpiredKeys.
+	DataKeyTTL time.Duration
+
+	// EncryptionPassphrase, when set, derives the master key from this
+	// passphrase via KDFAlgorithm instead of using a statically configured
+	// EncryptionKey. It is ignored for key derivation when KeyProvider is
+	// set, which takes precedence. The KDF salt and cost parameters are
+	// persisted in the KEYREGISTRY header so the same passphrase re-derives
+	// the same key on a later open.
+	EncryptionPassphrase string
+	// KDFAlgorithm selects the key-derivation function EncryptionPassphrase
+	// is run through. Defaults to KDFArgon2id.
+	KDFAlgorithm KDFAlgorithm
+	// KDFSaltLen is the length, in bytes, of the random salt generated for
+	// a new passphrase-derived master key. Defaults to 16.
+	KDFSaltLen int
+	// ScryptN, ScryptR, and ScryptP are the scrypt cost parameters used when
+	// KDFAlgorithm is KDFScrypt. Zero values fall back to conservative
+	// defaults.
+	ScryptN int
+	ScryptR int
+	ScryptP int
+	// Argon2Time, Argon2Memory, and Argon2Threads are the argon2id cost
+	// parameters used when KDFAlgorithm is KDFArgon2id. Zero values fall
+	// back to conservative defaults.
+	Argon2Time    uint32
+	Argon2Memory  uint32
+	Argon2Threads uint8
+}
+
+// Errorf forwards to opt.Logger if one is set, and is a no-op otherwise.
+func (opt Options) Errorf(format string, args ...interface{}) {
+	if opt.Logger != nil {
+		opt.Logger.Errorf(format, args...)
+	}
+}
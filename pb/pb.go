@@ -0,0 +1,145 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package pb holds the wire types persisted by Badger, such as the
+// KEYREGISTRY's DataKey record.
+package pb
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// DataKey is the record KeyRegistry persists, one per generated data key,
+// in the KEYREGISTRY file.
+type DataKey struct {
+	KeyId     uint64
+	Data      []byte
+	Iv        []byte
+	CreatedAt int64
+	// ExpiresAt is the unix timestamp after which KeyRegistry stops handing
+	// this key out for new writes, or 0 if the key never expires. It is set
+	// from Options.DataKeyTTL when the key is generated. A lookup by id
+	// still returns an expired key, so data already sealed under it stays
+	// decryptable.
+	ExpiresAt int64
+	// ProviderId is the KeyProvider.ID() of the provider that wrapped Data
+	// ("plain" for the no-master-key provider). It lets OpenKeyRegistry
+	// detect a registry being reopened under a different KeyProvider than
+	// the one it was written with; an empty ProviderId is not checked.
+	ProviderId string
+}
+
+// field tags, in the order Marshal writes them.
+const (
+	fieldKeyID      = 1
+	fieldData       = 2
+	fieldIv         = 3
+	fieldCreatedAt  = 4
+	fieldExpiresAt  = 5
+	fieldProviderID = 6
+)
+
+func putUvarintField(buf []byte, tag uint64, v uint64) []byte {
+	buf = appendUvarint(buf, tag)
+	return appendUvarint(buf, v)
+}
+
+func putBytesField(buf []byte, tag uint64, v []byte) []byte {
+	buf = appendUvarint(buf, tag)
+	buf = appendUvarint(buf, uint64(len(v)))
+	return append(buf, v...)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+// Marshal serializes k into Badger's DataKey wire format.
+func (k *DataKey) Marshal() ([]byte, error) {
+	buf := make([]byte, 0, 32+len(k.Data)+len(k.Iv))
+	buf = putUvarintField(buf, fieldKeyID, k.KeyId)
+	buf = putBytesField(buf, fieldData, k.Data)
+	buf = putBytesField(buf, fieldIv, k.Iv)
+	buf = putUvarintField(buf, fieldCreatedAt, uint64(k.CreatedAt))
+	if k.ExpiresAt != 0 {
+		buf = putUvarintField(buf, fieldExpiresAt, uint64(k.ExpiresAt))
+	}
+	if k.ProviderId != "" {
+		buf = putBytesField(buf, fieldProviderID, []byte(k.ProviderId))
+	}
+	return buf, nil
+}
+
+// Unmarshal decodes data, previously produced by Marshal, into k.
+func (k *DataKey) Unmarshal(data []byte) error {
+	*k = DataKey{}
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("pb: DataKey: truncated field tag")
+		}
+		data = data[n:]
+		switch tag {
+		case fieldKeyID:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("pb: DataKey: truncated KeyId")
+			}
+			k.KeyId = v
+			data = data[n:]
+		case fieldCreatedAt:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("pb: DataKey: truncated CreatedAt")
+			}
+			k.CreatedAt = int64(v)
+			data = data[n:]
+		case fieldExpiresAt:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("pb: DataKey: truncated ExpiresAt")
+			}
+			k.ExpiresAt = int64(v)
+			data = data[n:]
+		case fieldData, fieldIv, fieldProviderID:
+			l, n := binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("pb: DataKey: truncated length for field %d", tag)
+			}
+			data = data[n:]
+			if uint64(len(data)) < l {
+				return fmt.Errorf("pb: DataKey: truncated payload for field %d", tag)
+			}
+			v := make([]byte, l)
+			copy(v, data[:l])
+			switch tag {
+			case fieldData:
+				k.Data = v
+			case fieldIv:
+				k.Iv = v
+			case fieldProviderID:
+				k.ProviderId = string(v)
+			}
+			data = data[l:]
+		default:
+			return fmt.Errorf("pb: DataKey: unknown field tag %d", tag)
+		}
+	}
+	return nil
+}
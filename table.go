@@ -0,0 +1,98 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger/pb"
+	"github.com/dgraph-io/badger/y"
+)
+
+// Table represents a single immutable, sorted SSTable on disk. If the
+// table is encrypted, its content is a single XOR-ciphertext blob under the
+// data key identified by keyID and the table's own iv, the same envelope
+// storeDataKey uses for a data key's Data field.
+type Table struct {
+	path  string
+	keyID uint64
+	iv    []byte
+}
+
+// KeyID returns the ID of the data key this table's content is encrypted
+// under, or 0 if the table isn't encrypted.
+func (t *Table) KeyID() uint64 {
+	return t.keyID
+}
+
+// rewriteUnderKey re-encrypts t's on-disk content under newDK, writing to a
+// temp file and renaming it over t.path so a crash mid-rewrite can't leave
+// a half-written table in place. It returns the number of bytes read from
+// the old file.
+func (t *Table) rewriteUnderKey(oldDK, newDK *pb.DataKey) (int64, error) {
+	raw, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		return 0, err
+	}
+	plain := raw
+	if oldDK != nil {
+		if plain, err = y.XORBlock(raw, oldDK.Data, t.iv); err != nil {
+			return 0, err
+		}
+	}
+	newIV, err := y.GenereateIV()
+	if err != nil {
+		return 0, err
+	}
+	ciphertext := plain
+	if newDK != nil {
+		if ciphertext, err = y.XORBlock(plain, newDK.Data, newIV); err != nil {
+			return 0, err
+		}
+	}
+	tmpPath := t.path + ".rewrite"
+	fp, err := y.OpenTruncFile(tmpPath, false)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = fp.Write(ciphertext); err != nil {
+		fp.Close()
+		return 0, err
+	}
+	if err = y.FileSync(fp); err != nil {
+		fp.Close()
+		return 0, err
+	}
+	if err = fp.Close(); err != nil {
+		return 0, err
+	}
+	if err = os.Rename(tmpPath, t.path); err != nil {
+		return 0, err
+	}
+	if err = syncDir(filepath.Dir(t.path)); err != nil {
+		return 0, err
+	}
+	if newDK != nil {
+		t.keyID = newDK.KeyId
+	} else {
+		t.keyID = 0
+	}
+	t.iv = newIV
+	return int64(len(raw)), nil
+}
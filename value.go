@@ -0,0 +1,85 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"sync"
+)
+
+// vlogFile is a single value log file. Its content, like a Table's, is a
+// single XOR-ciphertext blob under the data key identified by keyID.
+type vlogFile struct {
+	table Table
+}
+
+// valueLog owns every value log file Badger has written.
+type valueLog struct {
+	sync.RWMutex
+	files []*vlogFile
+}
+
+// liveKeyIDs returns the data key ID every live value log file is
+// currently encrypted under.
+func (vlog *valueLog) liveKeyIDs() []uint64 {
+	vlog.RLock()
+	defer vlog.RUnlock()
+	ids := make([]uint64, 0, len(vlog.files))
+	for _, f := range vlog.files {
+		ids = append(ids, f.table.KeyID())
+	}
+	return ids
+}
+
+// rewriteBelowKeyID re-encrypts every value log file whose data key is
+// older than targetKeyID under vlog's current latest data key, via kr. It
+// returns the total number of bytes read from files it rewrote.
+func (vlog *valueLog) rewriteBelowKeyID(
+	ctx context.Context, kr *KeyRegistry, targetKeyID uint64, limiter *ioRateLimiter,
+) (int64, error) {
+	vlog.RLock()
+	files := make([]*vlogFile, len(vlog.files))
+	copy(files, vlog.files)
+	vlog.RUnlock()
+
+	var total int64
+	for _, f := range files {
+		select {
+		case <-ctx.Done():
+			return total, ctx.Err()
+		default:
+		}
+		if f.table.KeyID() >= targetKeyID {
+			continue
+		}
+		oldDK, err := kr.dataKey(f.table.KeyID())
+		if err != nil {
+			return total, err
+		}
+		newDK, err := kr.latestDataKey()
+		if err != nil {
+			return total, err
+		}
+		n, err := f.table.rewriteUnderKey(oldDK, newDK)
+		if err != nil {
+			return total, err
+		}
+		limiter.allow(n)
+		total += n
+	}
+	return total, nil
+}